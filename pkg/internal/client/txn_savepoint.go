@@ -0,0 +1,72 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package client
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/kv"
+	"github.com/pkg/errors"
+)
+
+// Savepoint is an opaque handle to a point in a transaction's write history,
+// established by Txn.CreateSavepoint for later use with
+// Txn.RollbackToSavepoint or Txn.ReleaseSavepoint. It is the client-visible
+// counterpart of kv.SavepointToken, threaded through so that SQL can
+// implement the SAVEPOINT family of statements without reaching into the kv
+// package directly.
+type Savepoint struct {
+	token kv.SavepointToken
+}
+
+// savepointSender is the subset of TxnSender that backs Txn's savepoint
+// methods. It is satisfied by *kv.TxnCoordSender.
+type savepointSender interface {
+	CreateSavepoint(ctx context.Context, name string) kv.SavepointToken
+	RollbackToSavepoint(ctx context.Context, tok kv.SavepointToken) error
+	ReleaseSavepoint(ctx context.Context, tok kv.SavepointToken) error
+}
+
+// CreateSavepoint establishes a savepoint with the given name at the current
+// point in txn's history. It is the client-visible counterpart of SQL's
+// SAVEPOINT statement.
+func (txn *Txn) CreateSavepoint(ctx context.Context, name string) (Savepoint, error) {
+	sender, ok := txn.Sender().(savepointSender)
+	if !ok {
+		return Savepoint{}, errors.Errorf("transaction sender does not support savepoints")
+	}
+	return Savepoint{token: sender.CreateSavepoint(ctx, name)}, nil
+}
+
+// RollbackToSavepoint rolls txn back to the point captured by sp, undoing
+// all of its writes since then. It is the client-visible counterpart of
+// SQL's ROLLBACK TO SAVEPOINT statement.
+func (txn *Txn) RollbackToSavepoint(ctx context.Context, sp Savepoint) error {
+	sender, ok := txn.Sender().(savepointSender)
+	if !ok {
+		return errors.Errorf("transaction sender does not support savepoints")
+	}
+	return sender.RollbackToSavepoint(ctx, sp.token)
+}
+
+// ReleaseSavepoint releases sp, forbidding any future rollback to it. It is
+// the client-visible counterpart of SQL's RELEASE SAVEPOINT statement.
+func (txn *Txn) ReleaseSavepoint(ctx context.Context, sp Savepoint) error {
+	sender, ok := txn.Sender().(savepointSender)
+	if !ok {
+		return errors.Errorf("transaction sender does not support savepoints")
+	}
+	return sender.ReleaseSavepoint(ctx, sp.token)
+}
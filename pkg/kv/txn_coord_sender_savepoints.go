@@ -0,0 +1,46 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import "context"
+
+// CreateSavepoint establishes a savepoint with the given name at the current
+// point in the transaction's history. The returned SavepointToken can later
+// be passed to RollbackToSavepoint or ReleaseSavepoint. It is the exported
+// entry point that client.Txn uses to back SQL's SAVEPOINT statement.
+func (tc *TxnCoordSender) CreateSavepoint(ctx context.Context, name string) SavepointToken {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.interceptorAlloc.txnSeqNumAllocator.createSavepointLocked(name)
+}
+
+// RollbackToSavepoint rolls the transaction back to the point captured by
+// tok, undoing all of its writes since then. It is the exported entry point
+// that client.Txn uses to back SQL's ROLLBACK TO SAVEPOINT statement; see
+// txnSeqNumAllocator.rollbackToSavepointLocked for the failure modes.
+func (tc *TxnCoordSender) RollbackToSavepoint(ctx context.Context, tok SavepointToken) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.interceptorAlloc.txnSeqNumAllocator.rollbackToSavepointLocked(ctx, tok)
+}
+
+// ReleaseSavepoint marks tok as released, forbidding any future rollback to
+// it. It is the exported entry point that client.Txn uses to back SQL's
+// RELEASE SAVEPOINT statement.
+func (tc *TxnCoordSender) ReleaseSavepoint(ctx context.Context, tok SavepointToken) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.interceptorAlloc.txnSeqNumAllocator.releaseSavepointLocked(ctx, tok)
+}
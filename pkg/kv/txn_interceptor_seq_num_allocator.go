@@ -0,0 +1,506 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/pkg/errors"
+)
+
+// idempotentReplayCacheMaxSize bounds the number of in-flight stamped
+// batches that SendLockedIdempotent will remember per-transaction. It is
+// sized generously above the degree of concurrency we expect a single
+// transaction to have in flight at once.
+const idempotentReplayCacheMaxSize = 64
+
+// idempotentReplayKey identifies a single stamped batch that was sent
+// through SendLockedIdempotent, so that a caller retrying after a transient
+// error (ambiguous result, connection reset, NLHE) can be handed back the
+// exact same request rather than having it re-stamped with fresh sequence
+// numbers.
+type idempotentReplayKey struct {
+	txnID    uuid.UUID
+	epoch    int32
+	firstSeq int32
+}
+
+// leafSeqNumExhaustedPolicy controls what a Leaf transaction coordinator
+// does when it runs out of leased sequence numbers.
+type leafSeqNumExhaustedPolicy int
+
+const (
+	// leafSeqNumFailFast fails the request outright rather than reaching
+	// back out to the Root for a new lease. Appropriate for Leaves that
+	// cannot tolerate the latency of a round-trip mid-batch.
+	leafSeqNumFailFast leafSeqNumExhaustedPolicy = iota
+	// leafSeqNumBlockAndRequestMore synchronously asks the Root for a new
+	// lease via requestMoreSeqNums and blocks the request until one is
+	// granted.
+	leafSeqNumBlockAndRequestMore
+)
+
+// leafSeqNumLeaseSize is the number of sequence numbers a Leaf requests at a
+// time when its lease is exhausted and onLeaseExhausted is
+// leafSeqNumBlockAndRequestMore.
+const leafSeqNumLeaseSize = 100
+
+// leafLease is the range of sequence numbers [lo, hi) that a Root has
+// handed to a Leaf coordinator via LeaseSequenceRange, for the Leaf to
+// allocate to writes locally without a round-trip back to the Root for
+// every one of them.
+type leafLease struct {
+	lo, hi int32
+}
+
+// txnSeqNumAllocator is a txnInterceptor in charge of allocating sequence
+// numbers to all the requests being sent as part of a transaction. Sequence
+// numbers are used by CockroachDB's concurrency control protocol to provide
+// idempotency for request replays and to allow a transaction to read its own
+// writes.
+//
+// Sequence numbers are also the foundation that SQL savepoints are built on:
+// a savepoint is little more than a remembered sequence number (plus enough
+// transaction state to tell that it is still valid) that writes performed
+// after it can later be unwound to.
+type txnSeqNumAllocator struct {
+	wrapped lockedSender
+
+	// writeSeq is the current write seq num. This is incremented on
+	// each write operation.
+	writeSeq int32
+
+	// txnEpoch records the current epoch of the transaction that this
+	// interceptor has observed. It is bumped by epochBumpedLocked and is
+	// used to recognize savepoints that were established in an epoch the
+	// transaction has since moved past.
+	txnEpoch int32
+
+	// savepoints is a stack of the currently-active savepoints, ordered from
+	// oldest to newest. Entries are removed once they are rolled back past
+	// or once the epoch advances.
+	savepoints []*savepoint
+
+	// idempotentReplays caches batches stamped by SendLockedIdempotent,
+	// keyed by idempotentReplayKey, so that a retry of a transient error can
+	// resend the identical batch instead of allocating new sequence
+	// numbers. It is allocated lazily, since most transactions never use
+	// SendLockedIdempotent.
+	idempotentReplays *cache.UnorderedCache
+
+	// reservedSeq is the highest sequence number that has been reserved for
+	// allocation on the Root - either by a Root-local write or by falling
+	// within a range handed out to a Leaf via LeaseSequenceRange. It is
+	// always >= writeSeq: writeSeq only advances to a reserved number once
+	// that number is confirmed used, either by a Root-local write or by
+	// folding in a Leaf's reported highestUsed through augmentMetaLocked.
+	// Keeping the two separate is what lets a Leaf's lease reserve a whole
+	// range up front - so nobody else can ever reuse it - without forcing
+	// writeSeq itself to jump ahead of what has actually been used.
+	reservedSeq int32
+
+	// isLeaf is true when this interceptor is installed on a Leaf
+	// transaction coordinator rather than the Root. A Leaf allocates write
+	// sequence numbers out of lease rather than incrementing a
+	// Root-synchronized counter on every write; writeSeq instead tracks the
+	// highest sequence number the Leaf has actually used, for reporting
+	// back to the Root via populateMetaLocked.
+	isLeaf bool
+
+	// lease is the range of sequence numbers [lo, hi) most recently handed
+	// to this Leaf by the Root via LeaseSequenceRange. Only meaningful when
+	// isLeaf is true.
+	lease leafLease
+
+	// leaseNext is the next sequence number this Leaf will hand out from
+	// lease. It satisfies lease.lo <= leaseNext <= lease.hi.
+	leaseNext int32
+
+	// onLeaseExhausted controls what a Leaf does once leaseNext reaches
+	// lease.hi.
+	onLeaseExhausted leafSeqNumExhaustedPolicy
+
+	// requestMoreSeqNums is called by a Leaf to synchronously request a new
+	// lease from the Root once the current one is exhausted and
+	// onLeaseExhausted is leafSeqNumBlockAndRequestMore.
+	requestMoreSeqNums func(ctx context.Context, n int32) (lo, hi int32, err error)
+}
+
+// savepoint is the interceptor-local state backing a SavepointToken: the
+// sequence number and epoch the transaction was at when the savepoint was
+// established.
+type savepoint struct {
+	name     string
+	seqNum   int32
+	epoch    int32
+	released bool
+}
+
+// SavepointToken is an opaque handle to a savepoint created by
+// createSavepointLocked. It is threaded back through client.Txn so that SQL
+// can implement SAVEPOINT, ROLLBACK TO SAVEPOINT, and RELEASE SAVEPOINT.
+type SavepointToken struct {
+	s *savepoint
+}
+
+// SendLocked implements the lockedSender interface.
+func (s *txnSeqNumAllocator) SendLocked(
+	ctx context.Context, ba roachpb.BatchRequest,
+) (*roachpb.BatchResponse, *roachpb.Error) {
+	if err := s.assignSeqNumsLocked(ctx, ba); err != nil {
+		return nil, roachpb.NewError(err)
+	}
+	return s.wrapped.SendLocked(ctx, ba)
+}
+
+// assignSeqNumsLocked stamps each transactional request in the batch with
+// the appropriate sequence number, drawing a fresh write sequence number for
+// each request that mutates transaction state (writes and EndTransaction).
+func (s *txnSeqNumAllocator) assignSeqNumsLocked(ctx context.Context, ba roachpb.BatchRequest) error {
+	for _, ru := range ba.Requests {
+		req := ru.GetInner()
+		if !roachpb.IsTransactional(req) {
+			continue
+		}
+
+		seq := s.writeSeq
+		if roachpb.IsTransactionWrite(req) || req.Method() == roachpb.EndTransaction {
+			var err error
+			seq, err = s.nextWriteSeqLocked(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		oldHeader := req.Header()
+		oldHeader.Sequence = seq
+		req.SetHeader(oldHeader)
+	}
+	return nil
+}
+
+// nextWriteSeqLocked returns the next sequence number to stamp on a write,
+// advancing whatever internal state backs it. On a Root coordinator this
+// simply increments the local counter. On a Leaf it draws from the current
+// lease handed out by LeaseSequenceRange; once that is exhausted it either
+// fails or blocks to request more, according to onLeaseExhausted.
+func (s *txnSeqNumAllocator) nextWriteSeqLocked(ctx context.Context) (int32, error) {
+	if !s.isLeaf {
+		s.reservedSeq++
+		s.writeSeq = s.reservedSeq
+		return s.writeSeq, nil
+	}
+
+	if s.leaseNext >= s.lease.hi {
+		if err := s.refreshLeaseLocked(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	seq := s.leaseNext
+	s.leaseNext++
+	if seq > s.writeSeq {
+		s.writeSeq = seq
+	}
+	return seq, nil
+}
+
+// refreshLeaseLocked is called when a Leaf has exhausted its current
+// sequence number lease and needs more before it can stamp another write.
+func (s *txnSeqNumAllocator) refreshLeaseLocked(ctx context.Context) error {
+	switch s.onLeaseExhausted {
+	case leafSeqNumFailFast:
+		return errors.Errorf(
+			"leaf transaction coordinator exhausted its sequence number lease [%d, %d)",
+			s.lease.lo, s.lease.hi)
+	case leafSeqNumBlockAndRequestMore:
+		if s.requestMoreSeqNums == nil {
+			return errors.Errorf("leaf has no way to request more sequence numbers")
+		}
+		lo, hi, err := s.requestMoreSeqNums(ctx, leafSeqNumLeaseSize)
+		if err != nil {
+			return err
+		}
+		s.lease = leafLease{lo: lo, hi: hi}
+		s.leaseNext = lo
+		return nil
+	default:
+		panic(errors.Errorf("unknown leafSeqNumExhaustedPolicy %d", s.onLeaseExhausted))
+	}
+}
+
+// LeaseSequenceRange hands a Leaf transaction coordinator a contiguous range
+// of n sequence numbers [lo, hi) that it may allocate to writes locally,
+// without synchronizing with the Root on every write. Only meaningful when
+// called on the Root's interceptor. The range is reserved against
+// reservedSeq immediately - so no other Leaf or Root-local write can ever be
+// given a number from it - but writeSeq itself is left untouched, since
+// nothing in the range is actually used yet. The Leaf is expected to report
+// back the highest sequence number it actually used via populateMetaLocked
+// once it returns its TxnCoordMeta to the Root, which augmentMetaLocked
+// folds into writeSeq.
+func (s *txnSeqNumAllocator) LeaseSequenceRange(n int32) (lo, hi int32) {
+	if n <= 0 {
+		panic(errors.Errorf("n must be positive, got %d", n))
+	}
+	lo = s.reservedSeq + 1
+	hi = lo + n
+	s.reservedSeq = hi - 1
+	return lo, hi
+}
+
+// SendLockedIdempotent sends ba much like SendLocked, except that it stamps
+// sequence numbers exactly once per logical batch and remembers the stamped
+// batch under (txnID, epoch, firstSeq). If the caller invokes
+// SendLockedIdempotent again with the very same ba - because, e.g., the
+// previous attempt returned an ambiguous result and the caller is retrying
+// it verbatim - firstSeq is recovered from the sequence numbers ba was
+// already stamped with rather than recomputed from the (by-then-advanced)
+// write sequence counter, the cached, already-stamped batch is sent instead
+// of re-assigning sequence numbers. This lets the server-side
+// sequence-cache/txn-record path recognize the retry as a duplicate of a
+// write it may have already applied, rather than as a new write.
+func (s *txnSeqNumAllocator) SendLockedIdempotent(
+	ctx context.Context, ba roachpb.BatchRequest,
+) (*roachpb.BatchResponse, *roachpb.Error) {
+	s.ensureIdempotentReplayCacheLocked()
+
+	firstSeq := firstWriteSeqOf(ba)
+	if firstSeq == 0 {
+		// ba hasn't been stamped yet - this is the first attempt at it.
+		if err := s.assignSeqNumsLocked(ctx, ba); err != nil {
+			return nil, roachpb.NewError(err)
+		}
+		firstSeq = firstWriteSeqOf(ba)
+	}
+
+	var pErr *roachpb.Error
+	var br *roachpb.BatchResponse
+	if firstSeq == 0 {
+		// ba contains no write (or EndTransaction) request, so there is
+		// nothing to key a replay cache entry on; just send it.
+		br, pErr = s.wrapped.SendLocked(ctx, ba)
+	} else {
+		key := idempotentReplayKey{txnID: ba.Txn.ID, epoch: s.txnEpoch, firstSeq: firstSeq}
+		if cached, ok := s.idempotentReplays.Get(key); ok {
+			ba = cached.(roachpb.BatchRequest)
+		} else {
+			s.idempotentReplays.Add(key, ba)
+		}
+		br, pErr = s.wrapped.SendLocked(ctx, ba)
+	}
+
+	if pErr == nil && ba.IsCompleteTransaction() {
+		// There's nothing left to retry once the transaction has committed.
+		s.clearIdempotentReplaysLocked()
+	}
+	return br, pErr
+}
+
+// firstWriteSeqOf returns the sequence number stamped on the first write (or
+// EndTransaction) request in ba, or zero if ba contains no such request or
+// none has been stamped yet (writes are never assigned sequence number
+// zero; see assignSeqNumsLocked).
+func firstWriteSeqOf(ba roachpb.BatchRequest) int32 {
+	for _, ru := range ba.Requests {
+		req := ru.GetInner()
+		if roachpb.IsTransactionWrite(req) || req.Method() == roachpb.EndTransaction {
+			return req.Header().Sequence
+		}
+	}
+	return 0
+}
+
+// ensureIdempotentReplayCacheLocked lazily initializes the replay cache the
+// first time SendLockedIdempotent is called.
+func (s *txnSeqNumAllocator) ensureIdempotentReplayCacheLocked() {
+	if s.idempotentReplays == nil {
+		s.idempotentReplays = cache.NewUnorderedCache(cache.Config{
+			Policy: cache.CacheLRU,
+			ShouldEvict: func(size int, _, _ interface{}) bool {
+				return size > idempotentReplayCacheMaxSize
+			},
+		})
+	}
+}
+
+// clearIdempotentReplaysLocked drops all cached in-flight batches. It is
+// called on an epoch bump, since none of the cached batches - stamped with
+// sequence numbers from the old epoch - can ever be validly resent, and on
+// a successful commit, since there's nothing left to retry.
+func (s *txnSeqNumAllocator) clearIdempotentReplaysLocked() {
+	if s.idempotentReplays != nil {
+		s.idempotentReplays.Clear()
+	}
+}
+
+// createSavepointLocked establishes a new savepoint anchored at the current
+// write sequence number and transaction epoch. The returned token can later
+// be passed to rollbackToSavepointLocked or releaseSavepointLocked.
+func (s *txnSeqNumAllocator) createSavepointLocked(name string) SavepointToken {
+	sp := &savepoint{
+		name:   name,
+		seqNum: s.writeSeq,
+		epoch:  s.txnEpoch,
+	}
+	s.savepoints = append(s.savepoints, sp)
+	return SavepointToken{s: sp}
+}
+
+// rollbackToSavepointLocked restores writeSeq to the value it held when tok
+// was created and asks the wrapped interceptors - ultimately the
+// intent-tracking interceptor - to resolve any intents laid down at a
+// sequence number greater than the savepoint's. Rollback fails if the
+// transaction has since restarted under a new epoch: sequence numbers reset
+// on an epoch bump (see TestSequenceNumberAllocationAfterEpochBump), so
+// seqNum no longer identifies a point in the current epoch's history.
+func (s *txnSeqNumAllocator) rollbackToSavepointLocked(ctx context.Context, tok SavepointToken) error {
+	sp := tok.s
+	if sp.released {
+		return errors.Errorf("cannot rollback to %q: savepoint has already been released", sp.name)
+	}
+	if sp.epoch != s.txnEpoch {
+		return errors.Errorf(
+			"cannot rollback to %q: transaction epoch changed from %d to %d since the savepoint was created",
+			sp.name, sp.epoch, s.txnEpoch)
+	}
+
+	idx := s.indexOfSavepointLocked(sp)
+	if idx < 0 {
+		return errors.Errorf(
+			"cannot rollback to %q: savepoint is stale, a savepoint created before it was already rolled back past",
+			sp.name)
+	}
+
+	if err := s.wrapped.rollbackSeqNumLocked(ctx, sp.seqNum); err != nil {
+		return err
+	}
+	s.writeSeq = sp.seqNum
+
+	// Drop every savepoint created after sp (but keep sp itself); none of
+	// them refer to a valid point in the transaction's history any more,
+	// and their tokens must be rejected as stale if used from here on.
+	s.savepoints = s.savepoints[:idx+1]
+	return nil
+}
+
+// releaseSavepointLocked marks tok as released. A released savepoint can no
+// longer be rolled back to, but otherwise releasing is a no-op: sequence
+// numbers only ever increase within an epoch, so there is nothing to
+// reclaim.
+func (s *txnSeqNumAllocator) releaseSavepointLocked(ctx context.Context, tok SavepointToken) error {
+	sp := tok.s
+	if sp.released {
+		return errors.Errorf("cannot release %q: savepoint has already been released", sp.name)
+	}
+	if s.indexOfSavepointLocked(sp) < 0 {
+		return errors.Errorf(
+			"cannot release %q: savepoint is stale, a savepoint created before it was already rolled back past",
+			sp.name)
+	}
+	sp.released = true
+	return nil
+}
+
+// indexOfSavepointLocked returns sp's position in s.savepoints, or -1 if sp
+// is no longer on the stack. A savepoint drops off the stack - without ever
+// having sp.released set - when an earlier savepoint is rolled back past it;
+// its token must not be usable afterwards, so every caller that accepts a
+// SavepointToken checks membership here rather than relying on released
+// alone.
+func (s *txnSeqNumAllocator) indexOfSavepointLocked(sp *savepoint) int {
+	for i, other := range s.savepoints {
+		if other == sp {
+			return i
+		}
+	}
+	return -1
+}
+
+// epochBumpedLocked implements the txnInterceptor interface.
+func (s *txnSeqNumAllocator) epochBumpedLocked() {
+	s.writeSeq = 0
+	s.reservedSeq = 0
+	s.txnEpoch++
+	// No savepoint taken in a prior epoch can ever be rolled back to again,
+	// since writeSeq has just reset to zero for the new epoch.
+	s.savepoints = nil
+	s.clearIdempotentReplaysLocked()
+	// Any outstanding Leaf lease was issued against sequence numbers from
+	// the old epoch and is no longer valid.
+	s.lease = leafLease{}
+	s.leaseNext = 0
+}
+
+// populateMetaLocked implements the txnInterceptor interface. On a Leaf,
+// writeSeq tracks the highest sequence number actually used (rather than
+// the tail of its lease), so reporting it here is exactly the "highestUsed"
+// value the Root needs to fold into its own counter.
+func (s *txnSeqNumAllocator) populateMetaLocked(meta *roachpb.TxnCoordMeta) {
+	meta.Txn.Sequence = s.writeSeq
+	meta.Savepoints = nil
+	for _, sp := range s.savepoints {
+		meta.Savepoints = append(meta.Savepoints, roachpb.SavepointMeta{
+			Name:     sp.name,
+			SeqNum:   sp.seqNum,
+			Epoch:    sp.epoch,
+			Released: sp.released,
+		})
+	}
+}
+
+// augmentMetaLocked implements the txnInterceptor interface. It is used to
+// update this interceptor's state based on an updated TxnCoordMeta, received
+// from a Leaf transaction coordinator or from the KV layer directly. Taking
+// the max of meta.Txn.Sequence and the Root's own counter, across calls from
+// however many Leaves the Root has spawned plus any Root-local allocations,
+// is what guarantees no sequence number is ever reused within an epoch. This
+// has to bump reservedSeq as well as writeSeq: a Leaf's highestUsed can
+// report a value the Root has never itself reserved (e.g. because the Leaf
+// is the only one that has written so far), and if reservedSeq were left
+// behind, the very next Root-local write would hand out a sequence number
+// that the Leaf already used.
+func (s *txnSeqNumAllocator) augmentMetaLocked(meta roachpb.TxnCoordMeta) {
+	if meta.Txn.Sequence > s.writeSeq {
+		s.writeSeq = meta.Txn.Sequence
+	}
+	if meta.Txn.Sequence > s.reservedSeq {
+		s.reservedSeq = meta.Txn.Sequence
+	}
+	// A Leaf only ever needs to know about savepoints the Root had already
+	// established when the Leaf was spawned; adopt them verbatim so that a
+	// rollback issued through the Root stays consistent with what the Leaf
+	// believes is active. An interceptor that already has savepoints of its
+	// own (such as the Root folding in a Leaf's meta) keeps them, so that the
+	// tokens it handed out remain valid.
+	if len(s.savepoints) == 0 && len(meta.Savepoints) > 0 {
+		savepoints := make([]*savepoint, len(meta.Savepoints))
+		for i, spMeta := range meta.Savepoints {
+			savepoints[i] = &savepoint{
+				name:     spMeta.Name,
+				seqNum:   spMeta.SeqNum,
+				epoch:    spMeta.Epoch,
+				released: spMeta.Released,
+			}
+		}
+		s.savepoints = savepoints
+	}
+}
+
+// closeLocked implements the txnInterceptor interface.
+func (*txnSeqNumAllocator) closeLocked() {}
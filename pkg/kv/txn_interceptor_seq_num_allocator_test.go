@@ -252,3 +252,379 @@ func TestSequenceNumberAllocationAfterAugmentation(t *testing.T) {
 	s.populateMetaLocked(&outMeta)
 	require.Equal(t, int32(6), outMeta.Txn.Sequence)
 }
+
+// TestSequenceNumberAllocationSavepoints tests the basic lifecycle of a
+// savepoint: creating one, writing past it, and rolling back to it restores
+// writeSeq and asks the wrapped sender to resolve the intervening intents.
+func TestSequenceNumberAllocationSavepoints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	s, mockSender := makeMockTxnSeqNumAllocator()
+
+	txn := makeTxnProto()
+	keyA := roachpb.Key("a")
+
+	var ba roachpb.BatchRequest
+	ba.Header = roachpb.Header{Txn: &txn}
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+
+	mockSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+	_, pErr := s.SendLocked(ctx, ba)
+	require.Nil(t, pErr)
+	require.Equal(t, int32(1), s.writeSeq)
+
+	tok := s.createSavepointLocked("s1")
+
+	ba.Requests = nil
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+	_, pErr = s.SendLocked(ctx, ba)
+	require.Nil(t, pErr)
+	require.Equal(t, int32(2), s.writeSeq)
+
+	mockSender.rollbackSeqNum = func(seq int32) error {
+		require.Equal(t, int32(1), seq)
+		return nil
+	}
+	require.NoError(t, s.rollbackToSavepointLocked(ctx, tok))
+	require.Equal(t, int32(1), s.writeSeq)
+
+	// Rolling back again should still succeed - nothing prevents rolling
+	// back to the same savepoint more than once.
+	require.NoError(t, s.rollbackToSavepointLocked(ctx, tok))
+	require.Equal(t, int32(1), s.writeSeq)
+
+	require.NoError(t, s.releaseSavepointLocked(ctx, tok))
+	require.Error(t, s.releaseSavepointLocked(ctx, tok))
+}
+
+// TestSequenceNumberAllocationSavepointsStaleToken tests that a savepoint's
+// token is rejected once an earlier savepoint has been rolled back past it,
+// even though the token itself was never released.
+func TestSequenceNumberAllocationSavepointsStaleToken(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	s, mockSender := makeMockTxnSeqNumAllocator()
+
+	txn := makeTxnProto()
+	keyA := roachpb.Key("a")
+
+	tok1 := s.createSavepointLocked("s1")
+
+	var ba roachpb.BatchRequest
+	ba.Header = roachpb.Header{Txn: &txn}
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+	mockSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+	_, pErr := s.SendLocked(ctx, ba)
+	require.Nil(t, pErr)
+	require.Equal(t, int32(1), s.writeSeq)
+
+	tok2 := s.createSavepointLocked("s2")
+
+	mockSender.rollbackSeqNum = func(seq int32) error {
+		require.Equal(t, int32(0), seq)
+		return nil
+	}
+	require.NoError(t, s.rollbackToSavepointLocked(ctx, tok1))
+	require.Equal(t, int32(0), s.writeSeq)
+
+	// tok2 was never released, but it no longer refers to a valid point in
+	// the transaction's history: rolling back to it - or releasing it -
+	// must be rejected rather than silently winding writeSeq forward again
+	// to a point whose writes have already been rolled back.
+	err := s.rollbackToSavepointLocked(ctx, tok2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "stale")
+	require.Equal(t, int32(0), s.writeSeq)
+
+	err = s.releaseSavepointLocked(ctx, tok2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "stale")
+}
+
+// TestSequenceNumberAllocationSavepointsAfterEpochBump tests that a
+// savepoint created in a prior epoch can no longer be rolled back to, since
+// sequence numbers are reset across epoch bumps.
+func TestSequenceNumberAllocationSavepointsAfterEpochBump(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	s, _ := makeMockTxnSeqNumAllocator()
+
+	tok := s.createSavepointLocked("s1")
+	s.epochBumpedLocked()
+
+	err := s.rollbackToSavepointLocked(ctx, tok)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "transaction epoch changed")
+}
+
+// TestSendLockedIdempotentReplay tests that retrying the exact same
+// BatchRequest through SendLockedIdempotent resends it with the sequence
+// numbers it was originally stamped with, rather than allocating new ones,
+// and does not advance writeSeq any further.
+func TestSendLockedIdempotentReplay(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	s, mockSender := makeMockTxnSeqNumAllocator()
+
+	txn := makeTxnProto()
+	keyA := roachpb.Key("a")
+
+	var ba roachpb.BatchRequest
+	ba.Header = roachpb.Header{Txn: &txn}
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+	ba.Add(&roachpb.InitPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+
+	mockSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		require.Equal(t, int32(1), ba.Requests[0].GetInner().Header().Sequence)
+		require.Equal(t, int32(2), ba.Requests[1].GetInner().Header().Sequence)
+
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+
+	_, pErr := s.SendLockedIdempotent(ctx, ba)
+	require.Nil(t, pErr)
+	require.Equal(t, int32(2), s.writeSeq)
+
+	// Simulate the caller retrying the exact same BatchRequest object after
+	// an ambiguous result. Its requests are already stamped from the first
+	// attempt, so it must be recognized as a replay, resent with the same
+	// sequence numbers, and must not advance writeSeq any further.
+	mockSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		require.Equal(t, int32(1), ba.Requests[0].GetInner().Header().Sequence)
+		require.Equal(t, int32(2), ba.Requests[1].GetInner().Header().Sequence)
+
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+
+	_, pErr = s.SendLockedIdempotent(ctx, ba)
+	require.Nil(t, pErr)
+	require.Equal(t, int32(2), s.writeSeq)
+}
+
+// TestSendLockedIdempotentReplayInvalidatedByEpochBump tests that the
+// idempotent replay cache is dropped when the transaction's epoch is
+// bumped, since sequence numbers from the old epoch can never again be
+// validly resent.
+func TestSendLockedIdempotentReplayInvalidatedByEpochBump(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	s, mockSender := makeMockTxnSeqNumAllocator()
+
+	txn := makeTxnProto()
+	keyA := roachpb.Key("a")
+
+	var ba roachpb.BatchRequest
+	ba.Header = roachpb.Header{Txn: &txn}
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+
+	mockSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+	_, pErr := s.SendLockedIdempotent(ctx, ba)
+	require.Nil(t, pErr)
+	require.NotNil(t, s.idempotentReplays)
+
+	s.epochBumpedLocked()
+
+	// The cache should have been cleared, not merely left stale, so a
+	// lookup using the new epoch can never spuriously hit an entry from the
+	// old one.
+	_, ok := s.idempotentReplays.Get(idempotentReplayKey{txnID: txn.ID, epoch: 0, firstSeq: 1})
+	require.False(t, ok)
+}
+
+// TestLeaseSequenceRange tests that the Root hands out non-overlapping
+// ranges of sequence numbers, reserved against reservedSeq so that neither a
+// Root-local write nor a later lease ever reuses a sequence number from a
+// range that has already been leased out. writeSeq - the high-water mark of
+// sequence numbers actually *used*, which is what's reported in a
+// TxnCoordMeta - is left untouched, since granting a lease doesn't by
+// itself use any of the numbers in it.
+func TestLeaseSequenceRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, _ := makeMockTxnSeqNumAllocator()
+
+	lo, hi := s.LeaseSequenceRange(100)
+	require.Equal(t, int32(1), lo)
+	require.Equal(t, int32(101), hi)
+	require.Equal(t, int32(0), s.writeSeq)
+
+	lo2, hi2 := s.LeaseSequenceRange(50)
+	require.Equal(t, int32(101), lo2)
+	require.Equal(t, int32(151), hi2)
+	require.Equal(t, int32(0), s.writeSeq)
+}
+
+// TestLeafSequenceNumberAllocation exercises interleaved Root and Leaf
+// writes against a leased range, proving that no sequence number is ever
+// reused within an epoch and that a read-only request on the Leaf still
+// stamps with the Leaf's local high-water mark.
+func TestLeafSequenceNumberAllocation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	root, _ := makeMockTxnSeqNumAllocator()
+	lo, hi := root.LeaseSequenceRange(10)
+
+	leaf, leafSender := makeMockTxnSeqNumAllocator()
+	leaf.isLeaf = true
+	leaf.lease = leafLease{lo: lo, hi: hi}
+	leaf.leaseNext = lo
+
+	txn := makeTxnProto()
+	keyA := roachpb.Key("a")
+
+	var ba roachpb.BatchRequest
+	ba.Header = roachpb.Header{Txn: &txn}
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+	ba.Add(&roachpb.InitPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+
+	leafSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		require.Equal(t, lo, ba.Requests[0].GetInner().Header().Sequence)
+		require.Equal(t, lo+1, ba.Requests[1].GetInner().Header().Sequence)
+
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+	_, pErr := leaf.SendLocked(ctx, ba)
+	require.Nil(t, pErr)
+	require.Equal(t, lo+1, leaf.writeSeq)
+
+	// A read-only request on the Leaf stamps with the Leaf's own
+	// high-water mark, not the Root's.
+	ba.Requests = nil
+	ba.Add(&roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+	leafSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		require.Equal(t, lo+1, ba.Requests[0].GetInner().Header().Sequence)
+
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+	_, pErr = leaf.SendLocked(ctx, ba)
+	require.Nil(t, pErr)
+
+	// The Leaf reports its highest used sequence number, and the Root folds
+	// it in as the max across the two.
+	var meta roachpb.TxnCoordMeta
+	leaf.populateMetaLocked(&meta)
+	require.Equal(t, lo+1, meta.Txn.Sequence)
+
+	root.augmentMetaLocked(meta)
+	require.Equal(t, lo+1, root.writeSeq)
+
+	// A Root-local write issued after the augment must not reuse any
+	// sequence number the Leaf already used - or, for that matter, any
+	// number anywhere in the range the Root leased out, since the Leaf may
+	// not be done with it.
+	ba.Requests = nil
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+
+	_, rootSender := makeMockTxnSeqNumAllocator()
+	root.wrapped = rootSender
+	rootSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		seq := ba.Requests[0].GetInner().Header().Sequence
+		require.True(t, seq >= hi, "write landed inside the leased range: got seq %d, leased range was [%d, %d)", seq, lo, hi)
+
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+	_, pErr = root.SendLocked(ctx, ba)
+	require.Nil(t, pErr)
+}
+
+// TestLeafSequenceNumberAllocationExhaustedFailFast tests that a Leaf
+// configured with leafSeqNumFailFast returns an error, rather than blocking,
+// once it runs out of its leased range.
+func TestLeafSequenceNumberAllocationExhaustedFailFast(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	leaf, _ := makeMockTxnSeqNumAllocator()
+	leaf.isLeaf = true
+	leaf.lease = leafLease{lo: 1, hi: 2}
+	leaf.leaseNext = 1
+	leaf.onLeaseExhausted = leafSeqNumFailFast
+
+	txn := makeTxnProto()
+	keyA := roachpb.Key("a")
+
+	var ba roachpb.BatchRequest
+	ba.Header = roachpb.Header{Txn: &txn}
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+	ba.Add(&roachpb.InitPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+
+	_, pErr := leaf.SendLocked(ctx, ba)
+	require.NotNil(t, pErr)
+	require.Contains(t, pErr.String(), "exhausted its sequence number lease")
+}
+
+// TestLeafSequenceNumberAllocationExhaustedBlockAndRequestMore tests that a
+// Leaf configured with leafSeqNumBlockAndRequestMore transparently fetches a
+// new lease from the Root once the current one runs out.
+func TestLeafSequenceNumberAllocationExhaustedBlockAndRequestMore(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	leaf, leafSender := makeMockTxnSeqNumAllocator()
+	leaf.isLeaf = true
+	leaf.lease = leafLease{lo: 1, hi: 2}
+	leaf.leaseNext = 1
+	leaf.onLeaseExhausted = leafSeqNumBlockAndRequestMore
+	leaf.requestMoreSeqNums = func(ctx context.Context, n int32) (int32, int32, error) {
+		require.Equal(t, int32(leafSeqNumLeaseSize), n)
+		return 100, 100 + n, nil
+	}
+
+	txn := makeTxnProto()
+	keyA := roachpb.Key("a")
+
+	var ba roachpb.BatchRequest
+	ba.Header = roachpb.Header{Txn: &txn}
+	ba.Add(&roachpb.ConditionalPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+	ba.Add(&roachpb.InitPutRequest{RequestHeader: roachpb.RequestHeader{Key: keyA}})
+
+	leafSender.MockSend(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		require.Equal(t, int32(1), ba.Requests[0].GetInner().Header().Sequence)
+		require.Equal(t, int32(100), ba.Requests[1].GetInner().Header().Sequence)
+
+		br := ba.CreateReply()
+		br.Txn = ba.Txn
+		return br, nil
+	})
+
+	_, pErr := leaf.SendLocked(ctx, ba)
+	require.Nil(t, pErr)
+	require.Equal(t, int32(101), leaf.leaseNext)
+}
+
+// TestLeafSequenceNumberAllocationLeaseInvalidatedByEpochBump tests that an
+// epoch bump invalidates a Leaf's outstanding lease.
+func TestLeafSequenceNumberAllocationLeaseInvalidatedByEpochBump(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	leaf, _ := makeMockTxnSeqNumAllocator()
+	leaf.isLeaf = true
+	leaf.lease = leafLease{lo: 1, hi: 10}
+	leaf.leaseNext = 5
+
+	leaf.epochBumpedLocked()
+
+	require.Equal(t, leafLease{}, leaf.lease)
+	require.Equal(t, int32(0), leaf.leaseNext)
+}